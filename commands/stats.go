@@ -0,0 +1,94 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/wallix/awless/database"
+	"github.com/wallix/awless/graph"
+	"github.com/wallix/awless/stats"
+)
+
+var (
+	statsShowFormat string
+	statsExportOut  string
+)
+
+// currentStatsSources loads the same database and local graphs SendStats
+// builds its payload from. RootCmd, currentDatabase and currentLocalGraphs
+// are wired up elsewhere in the commands package, same as loadPublicKey is
+// for stats itself; this snapshot only carries the stats-facing half.
+func currentStatsSources() (db *database.DB, infra, access *graph.Graph, err error) {
+	db, err = currentDatabase()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	infra, access, err = currentLocalGraphs(db)
+	return db, infra, access, err
+}
+
+func init() {
+	statsCmd.AddCommand(statsShowCmd)
+	statsCmd.AddCommand(statsExportCmd)
+
+	statsShowCmd.PersistentFlags().StringVar(&statsShowFormat, "format", "table", "Output format: json, table or csv")
+	statsExportCmd.PersistentFlags().StringVar(&statsExportOut, "out", "awless-stats.json.gz", "File to write the gzipped payload to")
+
+	RootCmd.AddCommand(statsCmd)
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Inspect or export the telemetry awless would otherwise send upstream",
+}
+
+var statsShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Render exactly what the next stats submission would contain",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, infra, access, err := currentStatsSources()
+		if err != nil {
+			return err
+		}
+
+		s, _, err := stats.BuildStats(db, infra, access, 0)
+		if err != nil {
+			return err
+		}
+
+		return (&stats.StdoutSink{W: cmd.OutOrStdout(), Format: statsShowFormat}).Send(s)
+	},
+}
+
+var statsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the gzipped, unencrypted stats payload to a file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, infra, access, err := currentStatsSources()
+		if err != nil {
+			return err
+		}
+
+		s, _, err := stats.BuildStats(db, infra, access, 0)
+		if err != nil {
+			return err
+		}
+
+		return (&stats.FileSink{Path: statsExportOut}).Send(s)
+	},
+}
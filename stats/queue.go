@@ -0,0 +1,97 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wallix/awless/database"
+)
+
+// HasPendingStats reports whether payloads from a previous failed delivery
+// are still sitting in the on-disk retry queue.
+func HasPendingStats(db *database.DB) bool {
+	pending, err := db.GetPendingStats()
+	return err == nil && len(pending) > 0
+}
+
+// drainPendingStats re-enqueues every payload left over from a previous
+// failed delivery, oldest first, onto the background Reporter.
+func drainPendingStats(db *database.DB) {
+	pending, err := db.GetPendingStats()
+	if err != nil {
+		return
+	}
+
+	for _, p := range pending {
+		s, err := decodeQueuedStat(p.Payload)
+		if err != nil {
+			continue
+		}
+		defaultReporter.Enqueue(db, p.ID, s)
+	}
+}
+
+// encodeQueuedStat and decodeQueuedStat are the on-disk format for a single
+// not-yet-delivered Stats: gzipped JSON, kept separate from the RSA-
+// encrypted wire payload a worker eventually sends, since a pending entry
+// may be re-batched differently on every retry.
+func encodeQueuedStat(s *Stats) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeQueuedStat(payload []byte) (*Stats, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var s Stats
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// parseRetryAfter parses an HTTP Retry-After header, as either a number of
+// seconds or an HTTP-date, returning 0 if it's absent or unparsable.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wallix/awless/config"
+	"github.com/wallix/awless/database"
+)
+
+const (
+	defaultBatchSize  = 20
+	defaultMaxWorkers = 4
+	defaultQueueSize  = 256
+
+	workerIdleTimeout = 10 * time.Second
+)
+
+// pendingJob pairs a Stats payload with the id it was persisted under in
+// db's on-disk retry queue, so a worker can delete the right record once
+// the batch it ends up in is acknowledged by the server.
+type pendingJob struct {
+	ID   int
+	Stat *Stats
+}
+
+// Reporter batches, encrypts and ships telemetry payloads to serverUrl on a
+// pool of worker goroutines, so nothing it does ever blocks the CLI command
+// that produced the payload: Enqueue drops a job rather than blocking when
+// the channel is full, since every job was already durably persisted by its
+// caller before reaching Enqueue (see SendStats and drainPendingStats in
+// queue.go), and a dropped job just waits for the next invocation's
+// drainPendingStats instead of being lost. It is modeled on Minio's HTTP
+// logger target: an elastic pool of workers grows up to maxWorkers under
+// load and shrinks back down when idle.
+type Reporter struct {
+	queue   chan *pendingJob
+	dropped int64 // atomic
+	pending int64 // atomic: jobs handed to Enqueue that a worker hasn't resolved yet
+
+	currentWorkers atomic.Int32
+	maxWorkers     int32
+	batchSize      int
+
+	notBefore int64 // atomic unix nano; a 429/503 sets this so workers back off without sleeping
+
+	mu sync.Mutex
+	db *database.DB
+
+	wg sync.WaitGroup
+}
+
+// NewReporter returns a Reporter ready to accept payloads. batchSize,
+// maxWorkers and queueSize fall back to sane defaults when non-positive,
+// which lets callers pass straight through config values that may be unset.
+func NewReporter(batchSize, maxWorkers, queueSize int) *Reporter {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	if maxWorkers <= 0 {
+		maxWorkers = defaultMaxWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	return &Reporter{
+		queue:      make(chan *pendingJob, queueSize),
+		maxWorkers: int32(maxWorkers),
+		batchSize:  batchSize,
+	}
+}
+
+var defaultReporter = NewReporter(config.StatsBatchSize, config.StatsWorkers, config.StatsQueueSize)
+
+// Enqueue schedules the payload already persisted under id for delivery,
+// spinning up a worker on demand if there's spare capacity.
+func (r *Reporter) Enqueue(db *database.DB, id int, s *Stats) {
+	r.mu.Lock()
+	r.db = db
+	r.mu.Unlock()
+
+	atomic.AddInt64(&r.pending, 1)
+	select {
+	case r.queue <- &pendingJob{ID: id, Stat: s}:
+		r.spawnWorkerIfNeeded()
+	default:
+		atomic.AddInt64(&r.pending, -1)
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+func (r *Reporter) currentDB() *database.DB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db
+}
+
+// Dropped returns the number of jobs dropped so far because the channel
+// was full.
+func (r *Reporter) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// Flush blocks until every job handed to Enqueue has been resolved (delivered,
+// or left in the on-disk queue for next time), or ctx is done.
+func (r *Reporter) Flush(ctx context.Context) error {
+	for {
+		if atomic.LoadInt64(&r.pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// spawnWorkerIfNeeded atomically increments currentWorkers and starts a
+// worker, unless maxWorkers is already reached. The compare-and-swap loop
+// guards against multiple producers racing to spawn past the cap.
+func (r *Reporter) spawnWorkerIfNeeded() {
+	for {
+		current := r.currentWorkers.Load()
+		if current >= r.maxWorkers {
+			return
+		}
+		if r.currentWorkers.CompareAndSwap(current, current+1) {
+			r.wg.Add(1)
+			go r.work()
+			return
+		}
+	}
+}
+
+// work pulls up to batchSize jobs off the queue and ships them as one POST.
+// A worker exits after sitting idle for workerIdleTimeout, shrinking the
+// pool back down between bursts of activity.
+func (r *Reporter) work() {
+	defer r.wg.Done()
+	defer r.currentWorkers.Add(-1)
+
+	for {
+		select {
+		case first, ok := <-r.queue:
+			if !ok {
+				return
+			}
+			batch := []*pendingJob{first}
+		drain:
+			for len(batch) < r.batchSize {
+				select {
+				case j := <-r.queue:
+					batch = append(batch, j)
+				default:
+					break drain
+				}
+			}
+			r.send(batch)
+			atomic.AddInt64(&r.pending, -int64(len(batch)))
+		case <-time.After(workerIdleTimeout):
+			return
+		}
+	}
+}
+
+// send encrypts and POSTs batch as a single array. On success it deletes
+// every job's entry from the on-disk queue; on failure (including a 429/503,
+// which also arms notBefore so later workers back off) it leaves them in
+// place for the next invocation's drainPendingStats to retry.
+func (r *Reporter) send(batch []*pendingJob) {
+	if nb := atomic.LoadInt64(&r.notBefore); nb > 0 && time.Now().UnixNano() < nb {
+		fmt.Fprintf(os.Stderr, "awless: stats: backing off, deferring batch of %d to the next invocation\n", len(batch))
+		return
+	}
+
+	publicKey, err := loadPublicKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		return
+	}
+
+	stats := make([]*Stats, len(batch))
+	for i, j := range batch {
+		stats[i] = j.Stat
+	}
+
+	var zipped bytes.Buffer
+	zippedW := gzip.NewWriter(&zipped)
+	if err := json.NewEncoder(zippedW).Encode(stats); err != nil {
+		fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		return
+	}
+	if err := zippedW.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		return
+	}
+
+	sessionKey, encrypted, err := aesEncrypt(zipped.Bytes())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		return
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, sessionKey, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		return
+	}
+
+	payload, err := json.Marshal(encryptedData{encryptedKey, encrypted})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		return
+	}
+
+	retryAfter, err := sendPayloadAndCheckUpgrade(serverUrl, payload, os.Stderr)
+	if err != nil {
+		if retryAfter > 0 {
+			atomic.StoreInt64(&r.notBefore, time.Now().Add(retryAfter).UnixNano())
+		}
+		fmt.Fprintf(os.Stderr, "awless: stats: sending batch of %d failed: %s\n", len(batch), err)
+		return
+	}
+
+	db := r.currentDB()
+	if db == nil {
+		return
+	}
+	for _, j := range batch {
+		if err := db.DeletePendingStat(j.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "awless: stats: %s\n", err)
+		}
+	}
+}
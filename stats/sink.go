@@ -0,0 +1,174 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wallix/awless/config"
+)
+
+// Sink delivers a built Stats payload somewhere. It is the seam `awless
+// stats show` and `awless stats export` hook into so they can reuse exactly
+// what SendStats would otherwise have shipped to serverUrl, without going
+// through the RSA encryption+POST path.
+type Sink interface {
+	Send(s *Stats) error
+}
+
+// NewSink returns an HTTPSink aimed at config.StatsEndpoint when it is set,
+// and at serverUrl otherwise. It never returns a FileSink or a StdoutSink,
+// and SendStats does not go through it: the background Reporter always
+// posts to serverUrl.
+func NewSink() Sink {
+	if config.StatsEndpoint != "" {
+		return &HTTPSink{URL: config.StatsEndpoint}
+	}
+	return &HTTPSink{URL: serverUrl}
+}
+
+// HTTPSink gzips, encrypts and POSTs a Stats payload to URL, same as the
+// background Reporter, but as a single one-shot send rather than a batch.
+type HTTPSink struct {
+	URL string
+}
+
+func (s *HTTPSink) Send(stat *Stats) error {
+	publicKey, err := loadPublicKey()
+	if err != nil {
+		return err
+	}
+
+	var zipped bytes.Buffer
+	zippedW := gzip.NewWriter(&zipped)
+	if err := json.NewEncoder(zippedW).Encode([]*Stats{stat}); err != nil {
+		return err
+	}
+	if err := zippedW.Close(); err != nil {
+		return err
+	}
+
+	sessionKey, encrypted, err := aesEncrypt(zipped.Bytes())
+	if err != nil {
+		return err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, sessionKey, nil)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(encryptedData{encryptedKey, encrypted})
+	if err != nil {
+		return err
+	}
+
+	_, err = sendPayloadAndCheckUpgrade(s.URL, payload, os.Stderr)
+	return err
+}
+
+// FileSink writes the gzipped, unencrypted JSON for a Stats payload to Path,
+// for regulated environments that want to inspect or forward telemetry to
+// their own collector instead of sending it to us.
+type FileSink struct {
+	Path string
+}
+
+func (s *FileSink) Send(stat *Stats) error {
+	f, err := os.Create(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	if err := json.NewEncoder(gzw).Encode([]*Stats{stat}); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// StdoutSink renders a Stats payload to W in Format ("json", "table" or
+// "csv"), for `awless stats show`. Unlike HTTPSink and FileSink it never
+// touches the network or the filesystem.
+type StdoutSink struct {
+	W      io.Writer
+	Format string
+}
+
+func (s *StdoutSink) Send(stat *Stats) error {
+	switch s.Format {
+	case "csv":
+		return writeStatsCSV(s.W, stat)
+	case "table", "":
+		return writeStatsTable(s.W, stat)
+	case "json":
+		enc := json.NewEncoder(s.W)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stat)
+	default:
+		return fmt.Errorf("stats: unknown format %q", s.Format)
+	}
+}
+
+func writeStatsTable(w io.Writer, s *Stats) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Id\t%s\n", s.Id)
+	fmt.Fprintf(tw, "Version\t%s\n", s.Version)
+	if s.InfraMetrics != nil {
+		fmt.Fprintf(tw, "Vpcs\t%d\n", s.InfraMetrics.NbVpcs)
+		fmt.Fprintf(tw, "Subnets\t%d\n", s.InfraMetrics.NbSubnets)
+		fmt.Fprintf(tw, "Instances\t%d\n", s.InfraMetrics.NbInstances)
+	}
+	if s.AccessMetrics != nil {
+		fmt.Fprintf(tw, "Groups\t%d\n", s.AccessMetrics.NbGroups)
+		fmt.Fprintf(tw, "Policies\t%d\n", s.AccessMetrics.NbPolicies)
+		fmt.Fprintf(tw, "Roles\t%d\n", s.AccessMetrics.NbRoles)
+		fmt.Fprintf(tw, "Users\t%d\n", s.AccessMetrics.NbUsers)
+	}
+	for _, c := range s.Commands {
+		fmt.Fprintf(tw, "Command\t%s\t%d\t%s\n", c.Command, c.Hits, c.Date.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func writeStatsCSV(w io.Writer, s *Stats) error {
+	cw := csv.NewWriter(w)
+	for _, c := range s.Commands {
+		if err := cw.Write([]string{"command", c.Command, strconv.Itoa(c.Hits), c.Date.Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	for _, is := range s.InstancesStats {
+		if err := cw.Write([]string{"instance", is.Type, is.Name, strconv.Itoa(is.Hits), is.Date.Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStdoutSinkFormats(t *testing.T) {
+	s := &Stats{
+		Id:      "abc",
+		Version: "1.2.3",
+		Commands: []*DailyCommands{
+			{Command: "create instance", Hits: 3},
+		},
+	}
+
+	for _, format := range []string{"json", "table", "csv", ""} {
+		var buf bytes.Buffer
+		sink := &StdoutSink{W: &buf, Format: format}
+		if err := sink.Send(s); err != nil {
+			t.Fatalf("format %q: %s", format, err)
+		}
+		if !strings.Contains(buf.String(), "create instance") {
+			t.Errorf("format %q: expected output to mention the command, got: %s", format, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&StdoutSink{W: &buf, Format: "xml"}).Send(s); err == nil {
+		t.Error("expected an unknown format to error")
+	}
+}
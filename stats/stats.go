@@ -18,17 +18,14 @@ package stats
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"runtime"
 	"strings"
 	"time"
@@ -43,11 +40,16 @@ var (
 	expirationDuration = 24 * time.Hour
 )
 
+// SendStats builds the telemetry payload for everything recorded since the
+// last run, persists it to the on-disk retry queue, and only then advances
+// SentIdKey and deletes the logs/history that fed it, so a crash or a failed
+// delivery can never lose the captured data. The payload is handed off to
+// the background Reporter last, to batch, encrypt and deliver it
+// asynchronously. Any payload left over from a previous failed delivery is
+// retried first, oldest first.
 func SendStats(db *database.DB, localInfra, localAccess *graph.Graph) error {
-	publicKey, err := loadPublicKey()
-	if err != nil {
-		return err
-	}
+	drainPendingStats(db)
+
 	lastCommandId, err := db.GetIntValue(database.SentIdKey)
 	if err != nil {
 		return err
@@ -58,28 +60,11 @@ func SendStats(db *database.DB, localInfra, localAccess *graph.Graph) error {
 		return err
 	}
 
-	var zipped bytes.Buffer
-	zippedW := gzip.NewWriter(&zipped)
-	if err = json.NewEncoder(zippedW).Encode(s); err != nil {
-		return err
-	}
-	zippedW.Close()
-
-	sessionKey, encrypted, err := aesEncrypt(zipped.Bytes())
-	if err != nil {
-		return err
-	}
-	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, sessionKey, nil)
-	if err != nil {
-		return err
-	}
-
-	payload, err := json.Marshal(encryptedData{encryptedKey, encrypted})
+	queued, err := encodeQueuedStat(s)
 	if err != nil {
 		return err
 	}
-
-	err = sendPayloadAndCheckUpgrade(serverUrl, payload, os.Stderr)
+	id, err := db.AddPendingStat(queued)
 	if err != nil {
 		return err
 	}
@@ -96,46 +81,75 @@ func SendStats(db *database.DB, localInfra, localAccess *graph.Graph) error {
 	if err := db.DeleteHistory(); err != nil {
 		return err
 	}
+
+	defaultReporter.Enqueue(db, id, s)
 	return nil
 }
 
-func sendPayloadAndCheckUpgrade(url string, payload []byte, w io.Writer) error {
+// Flush gives the background Reporter a chance to deliver anything still
+// queued before the process exits, up to ctx's deadline.
+func Flush(ctx context.Context) error {
+	return defaultReporter.Flush(ctx)
+}
+
+// sendPayloadAndCheckUpgrade POSTs payload to url and, on success, looks for
+// a signed upgrade manifest in the response. It returns a non-zero
+// retryAfter when the server responded 429/503 and asked the caller to back
+// off, so callers driving the on-disk retry queue know how long to wait. A
+// manifest that fails verification only suppresses the upgrade banner; it
+// never turns an already-delivered payload into a reported failure.
+func sendPayloadAndCheckUpgrade(url string, payload []byte, w io.Writer) (retryAfter time.Duration, err error) {
 	client := &http.Client{Timeout: 2 * time.Second}
 	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	latest := struct {
-		Version, URL string
-	}{}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		return parseRetryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("server responded %s", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("server responded %s", resp.Status)
+	}
 
+	var latest upgradeManifest
 	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&latest); err == nil {
-		if config.IsUpgrade(config.Version, latest.Version) {
-			var install string
-			switch config.BuildFor {
-			case "brew":
-				install = "Run `brew upgrade awless`"
-			default:
-				install = fmt.Sprintf("Run `wget -O awless-%s.zip https://github.com/wallix/awless/releases/download/%s/awless-%s-%s.zip`", latest.Version, latest.Version, runtime.GOOS, runtime.GOARCH)
-			}
-			fmt.Fprintf(w, "New version %s available. %s\n", latest.Version, install)
+	if err := dec.Decode(&latest); err != nil {
+		return 0, nil
+	}
+
+	if latest.Version == "" || latest.URL == "" || latest.SHA256 == "" {
+		return 0, nil
+	}
+
+	if err := VerifyUpgradeManifest(&latest); err != nil {
+		fmt.Fprintf(w, "awless: rejecting upgrade manifest: %s\n", err)
+		return 0, nil
+	}
+
+	if config.IsUpgrade(config.Version, latest.Version) {
+		var install string
+		switch config.BuildFor {
+		case "brew":
+			install = "Run `brew upgrade awless`"
+		default:
+			install = fmt.Sprintf("Run `wget -O awless-%s.zip https://github.com/wallix/awless/releases/download/%s/awless-%s-%s.zip`", latest.Version, latest.Version, runtime.GOOS, runtime.GOARCH)
 		}
+		fmt.Fprintf(w, "New version %s available. %s\n", latest.Version, install)
 	}
 
-	return nil
+	return 0, nil
 }
 
-func BuildStats(db *database.DB, infra *graph.Graph, access *graph.Graph, fromCommandId int) (*stats, int, error) {
+func BuildStats(db *database.DB, infra *graph.Graph, access *graph.Graph, fromCommandId int) (*Stats, int, error) {
 	commandsStat, lastCommandId, err := buildCommandsStat(db, fromCommandId)
 	if err != nil {
 		return nil, 0, err
 	}
 	region := db.MustGetDefaultRegion()
 
-	im := &infraMetrics{}
+	im := &InfraMetrics{}
 	if infra != nil {
 		im, err = buildInfraMetrics(region, infra)
 		if err != nil {
@@ -143,7 +157,7 @@ func BuildStats(db *database.DB, infra *graph.Graph, access *graph.Graph, fromCo
 		}
 	}
 
-	am := &accessMetrics{}
+	am := &AccessMetrics{}
 	if access != nil {
 		am, err = buildAccessMetrics(region, access, time.Now())
 		if err != nil {
@@ -171,7 +185,7 @@ func BuildStats(db *database.DB, infra *graph.Graph, access *graph.Graph, fromCo
 		return nil, 0, err
 	}
 
-	s := &stats{
+	s := &Stats{
 		Id:             id,
 		AId:            aId,
 		Version:        config.Version,
@@ -187,6 +201,10 @@ func BuildStats(db *database.DB, infra *graph.Graph, access *graph.Graph, fromCo
 }
 
 func CheckStatsToSend(db *database.DB) bool {
+	if HasPendingStats(db) {
+		return true
+	}
+
 	sent, err := db.GetTimeValue(database.SentTimeKey)
 	if err != nil {
 		sent = time.Time{}
@@ -194,32 +212,35 @@ func CheckStatsToSend(db *database.DB) bool {
 	return (time.Since(sent) > expirationDuration)
 }
 
-type stats struct {
+// Stats is exactly what SendStats serializes, encrypts and delivers. It is
+// also what `awless stats show`/`export` render, via the Sink interface, so
+// those commands always reflect exactly what would have been sent upstream.
+type Stats struct {
 	Id             string
 	AId            string
 	Version        string
 	BuildInfo      config.BuildInfo
-	Commands       []*dailyCommands
-	InfraMetrics   *infraMetrics
-	InstancesStats []*instancesStat
-	AccessMetrics  *accessMetrics
+	Commands       []*DailyCommands
+	InfraMetrics   *InfraMetrics
+	InstancesStats []*InstancesStat
+	AccessMetrics  *AccessMetrics
 	Logs           []*database.Log
 }
 
-type dailyCommands struct {
+type DailyCommands struct {
 	Command string
 	Hits    int
 	Date    time.Time
 }
 
-type instancesStat struct {
+type InstancesStat struct {
 	Type string
 	Date time.Time
 	Hits int
 	Name string
 }
 
-type accessMetrics struct {
+type AccessMetrics struct {
 	Date                     time.Time
 	Region                   string
 	NbGroups                 int
@@ -236,8 +257,8 @@ type accessMetrics struct {
 	MaxGroupsByLocalPolicies int
 }
 
-func buildCommandsStat(db *database.DB, fromCommandId int) ([]*dailyCommands, int, error) {
-	var commandsStat []*dailyCommands
+func buildCommandsStat(db *database.DB, fromCommandId int) ([]*DailyCommands, int, error) {
+	var commandsStat []*DailyCommands
 
 	commandsHistory, err := db.GetHistory(fromCommandId)
 	if err != nil {
@@ -265,7 +286,7 @@ func buildCommandsStat(db *database.DB, fromCommandId int) ([]*dailyCommands, in
 	return commandsStat, lastCommandId, nil
 }
 
-func buildInstancesStats(infra *graph.Graph) (instancesStats []*instancesStat, err error) {
+func buildInstancesStats(infra *graph.Graph) (instancesStats []*InstancesStat, err error) {
 	instancesStats, err = addStatsForInstanceStringProperty(infra, "Type", "InstanceType", instancesStats)
 	if err != nil {
 		return instancesStats, err
@@ -278,7 +299,7 @@ func buildInstancesStats(infra *graph.Graph) (instancesStats []*instancesStat, e
 	return instancesStats, err
 }
 
-func addStatsForInstanceStringProperty(infra *graph.Graph, propertyName string, instanceStatType string, instancesStats []*instancesStat) ([]*instancesStat, error) {
+func addStatsForInstanceStringProperty(infra *graph.Graph, propertyName string, instanceStatType string, instancesStats []*InstancesStat) ([]*InstancesStat, error) {
 	instances, err := infra.GetAllResources(graph.Instance)
 	if err != nil {
 		return nil, err
@@ -296,21 +317,21 @@ func addStatsForInstanceStringProperty(infra *graph.Graph, propertyName string,
 	}
 
 	for k, v := range propertyValuesCountMap {
-		instancesStats = append(instancesStats, &instancesStat{Type: instanceStatType, Date: time.Now(), Hits: v, Name: k})
+		instancesStats = append(instancesStats, &InstancesStat{Type: instanceStatType, Date: time.Now(), Hits: v, Name: k})
 	}
 
 	return instancesStats, err
 }
 
-func addDailyCommands(commandsStat []*dailyCommands, commands map[string]int, date *time.Time) []*dailyCommands {
+func addDailyCommands(commandsStat []*DailyCommands, commands map[string]int, date *time.Time) []*DailyCommands {
 	for command, hits := range commands {
-		dc := dailyCommands{Command: command, Hits: hits, Date: *date}
+		dc := DailyCommands{Command: command, Hits: hits, Date: *date}
 		commandsStat = append(commandsStat, &dc)
 	}
 	return commandsStat
 }
 
-type infraMetrics struct {
+type InfraMetrics struct {
 	Date                  time.Time
 	Region                string
 	NbVpcs                int
@@ -322,8 +343,8 @@ type infraMetrics struct {
 	MaxInstancesPerSubnet int
 }
 
-func buildInfraMetrics(region string, infra *graph.Graph) (*infraMetrics, error) {
-	metrics := &infraMetrics{
+func buildInfraMetrics(region string, infra *graph.Graph) (*InfraMetrics, error) {
+	metrics := &InfraMetrics{
 		Date:   time.Now(),
 		Region: region,
 	}
@@ -349,8 +370,8 @@ func buildInfraMetrics(region string, infra *graph.Graph) (*infraMetrics, error)
 	return metrics, nil
 }
 
-func buildAccessMetrics(region string, access *graph.Graph, time time.Time) (*accessMetrics, error) {
-	metrics := &accessMetrics{
+func buildAccessMetrics(region string, access *graph.Graph, time time.Time) (*AccessMetrics, error) {
+	metrics := &AccessMetrics{
 		Date:   time,
 		Region: region,
 	}
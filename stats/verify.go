@@ -0,0 +1,117 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wallix/awless/config"
+)
+
+// manifestMaxAge bounds how old a signed upgrade manifest may be. Rejecting
+// anything older prevents a captured, validly-signed response from being
+// replayed against a client indefinitely.
+const manifestMaxAge = 48 * time.Hour
+
+// upgradeManifest is what serverUrl returns to advertise a newer release. It
+// must be signed by the release-signing key pinned in config before
+// sendPayloadAndCheckUpgrade trusts any of its fields.
+type upgradeManifest struct {
+	Version   string
+	URL       string
+	SHA256    string
+	Timestamp time.Time
+	Signature []byte
+}
+
+// signedManifestFields is exactly what the release pipeline signs. Signature
+// itself is excluded, and Timestamp is included so a manifest can't be
+// replayed past manifestMaxAge.
+type signedManifestFields struct {
+	Version   string
+	URL       string
+	SHA256    string
+	Timestamp time.Time
+}
+
+// VerifyUpgradeManifest checks that m was signed by the release-signing key
+// pinned in config and that it hasn't expired. It is deliberately separate
+// from the RSA key loadPublicKey uses to encrypt stats payloads: compromise
+// of one key must not let an attacker forge the other's trust.
+func VerifyUpgradeManifest(m *upgradeManifest) error {
+	key, err := loadReleaseSigningKey()
+	if err != nil {
+		return err
+	}
+	return verifyManifestSignature(m, key)
+}
+
+func verifyManifestSignature(m *upgradeManifest, key *rsa.PublicKey) error {
+	if time.Since(m.Timestamp) > manifestMaxAge {
+		return fmt.Errorf("upgrade manifest expired: signed %s ago", time.Since(m.Timestamp))
+	}
+
+	digest, err := manifestDigest(m)
+	if err != nil {
+		return err
+	}
+
+	if err := rsa.VerifyPSS(key, crypto.SHA256, digest, m.Signature, nil); err != nil {
+		return fmt.Errorf("upgrade manifest signature verification failed: %s", err)
+	}
+
+	return nil
+}
+
+func manifestDigest(m *upgradeManifest) ([]byte, error) {
+	b, err := json.Marshal(signedManifestFields{Version: m.Version, URL: m.URL, SHA256: m.SHA256, Timestamp: m.Timestamp})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// loadReleaseSigningKey parses the release-signing public key pinned in
+// config. It is a separate key from the one loadPublicKey returns, which is
+// only used to encrypt outgoing stats payloads.
+func loadReleaseSigningKey() (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(config.ReleaseSigningKey))
+	if block == nil {
+		return nil, errors.New("stats: invalid release signing key PEM")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("stats: release signing key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
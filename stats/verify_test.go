@@ -0,0 +1,144 @@
+/*
+Copyright 2017 WALLIX
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless/config"
+)
+
+func signManifest(t *testing.T, key *rsa.PrivateKey, m *upgradeManifest) {
+	t.Helper()
+	digest, err := manifestDigest(m)
+	if err != nil {
+		t.Fatalf("computing digest: %s", err)
+	}
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest, nil)
+	if err != nil {
+		t.Fatalf("signing manifest: %s", err)
+	}
+	m.Signature = sig
+}
+
+func TestVerifyManifestSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating other key: %s", err)
+	}
+
+	newManifest := func() *upgradeManifest {
+		return &upgradeManifest{
+			Version:   "1.2.3",
+			URL:       "https://github.com/wallix/awless/releases/download/1.2.3/awless-1.2.3-linux-amd64.zip",
+			SHA256:    "deadbeef",
+			Timestamp: time.Now(),
+		}
+	}
+
+	t.Run("valid signature", func(t *testing.T) {
+		m := newManifest()
+		signManifest(t, key, m)
+		if err := verifyManifestSignature(m, &key.PublicKey); err != nil {
+			t.Errorf("expected valid manifest to verify, got: %s", err)
+		}
+	})
+
+	t.Run("tampered version", func(t *testing.T) {
+		m := newManifest()
+		signManifest(t, key, m)
+		m.Version = "9.9.9"
+		if err := verifyManifestSignature(m, &key.PublicKey); err == nil {
+			t.Error("expected tampered version to fail verification")
+		}
+	})
+
+	t.Run("tampered URL", func(t *testing.T) {
+		m := newManifest()
+		signManifest(t, key, m)
+		m.URL = "https://evil.example.com/awless.zip"
+		if err := verifyManifestSignature(m, &key.PublicKey); err == nil {
+			t.Error("expected tampered URL to fail verification")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		m := newManifest()
+		signManifest(t, key, m)
+		if err := verifyManifestSignature(m, &otherKey.PublicKey); err == nil {
+			t.Error("expected signature from a different key to fail verification")
+		}
+	})
+
+	t.Run("replayed (expired) manifest", func(t *testing.T) {
+		m := newManifest()
+		m.Timestamp = time.Now().Add(-manifestMaxAge - time.Hour)
+		signManifest(t, key, m)
+		if err := verifyManifestSignature(m, &key.PublicKey); err == nil {
+			t.Error("expected an expired manifest to fail verification")
+		}
+	})
+}
+
+func TestVerifyUpgradeManifest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshaling public key: %s", err)
+	}
+	pinned := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	old := config.ReleaseSigningKey
+	config.ReleaseSigningKey = pinned
+	defer func() { config.ReleaseSigningKey = old }()
+
+	m := &upgradeManifest{
+		Version:   "1.2.3",
+		URL:       "https://github.com/wallix/awless/releases/download/1.2.3/awless-1.2.3-linux-amd64.zip",
+		SHA256:    "deadbeef",
+		Timestamp: time.Now(),
+	}
+	signManifest(t, key, m)
+
+	if err := VerifyUpgradeManifest(m); err != nil {
+		t.Errorf("expected manifest signed with the pinned key to verify, got: %s", err)
+	}
+
+	m.Version = "9.9.9"
+	if err := VerifyUpgradeManifest(m); err == nil {
+		t.Error("expected tampered manifest to fail verification against the pinned key")
+	}
+
+	config.ReleaseSigningKey = "not a pem"
+	if err := VerifyUpgradeManifest(m); err == nil {
+		t.Error("expected a malformed pinned key to fail verification")
+	}
+}